@@ -69,8 +69,15 @@
 //	/v4/threatMatches:find
 //	/v4/threatLists
 //	/status
+//	/metrics
 //	/r
 //
+// The /metrics endpoint exposes Prometheus metrics for the counters already
+// available through /status, plus latency histograms for threatMatches
+// lookups and for the sb.LookupURLs calls behind them, and a gauge of the
+// time since sb.Status() was last polled successfully (not the database's
+// own update lag). By default it is served on the same listener
+// as the rest of the API; pass -metricsaddr to bind it on a separate one.
 //
 // Endpoint: /v4/threatMatches:find
 //
@@ -165,26 +172,73 @@
 //	}
 //
 //
+// Forward proxy mode
+//
+// Passing -proxyaddr runs sbserver as an HTTP/HTTPS forward proxy in
+// addition to the API surface above. HTTPS requests are MITM'd (the proxy
+// generates its own cert per CONNECT tunnel) so their decrypted URL can be
+// checked the same as plain HTTP. Every proxied request's absolute URL is
+// checked with sb.LookupURLs; a match is blocked with an interstitial page
+// listing the matched ThreatDescriptors and a "proceed anyway" link carrying
+// a signed, time-limited continue token, while safe requests are forwarded
+// unmodified. This lets LAN clients that cannot be changed to call
+// /v4/threatMatches:find directly still be protected.
+//
+// Authentication, rate limiting, and access logs
+//
+// /v4/threatMatches:find, /v4/threatLists, /status, and the Twirp handler
+// below are wrapped in a common middleware chain. Passing -apikeys requires requests to present one
+// of the listed keys (as a Bearer token or X-Api-Key header); -ratelimit
+// throttles requests per key (or per IP, if no key was presented) with a
+// token bucket. Every request to them is logged as one line of structured
+// JSON to stdout, including latency and, for /v4/threatMatches:find, the
+// decoded URL count and cache-hit/API-hit breakdown.
+//
+// Twirp RPC surface
+//
+// The same FindThreatMatches and ListThreatLists operations are also
+// available as a Twirp service under /twirp/safebrowsing.SafeBrowsing/,
+// accepting both JSON and protobuf bodies via Content-Type, for clients that
+// want typed stubs generated from safebrowsing.proto instead of hand-rolling
+// requests against the REST endpoints above.
+//
+// Shared cache backend
+//
+// findThreatMatches (used by both /v4/threatMatches:find and the Twirp RPC
+// above) caches its sb.LookupURLs results itself, keyed by the first 4 bytes
+// of SHA256(url) since sb does not expose the v4 API's own hash-prefix
+// computation. By default that cache is in-process, so N sbserver replicas
+// behind a load balancer each look up the same URL independently; passing
+// -cache=redis://... stores it in Redis instead (see the cache package),
+// with entries expired via SETEX, so replicas share it. Either way, lookups
+// go through a single-flight guard so concurrent requests within one sbserver
+// process for a URL that isn't yet cached share one sb.LookupURLs call
+// instead of each issuing their own; the guard does not span replicas.
+//
 package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"html/template"
 	"io/ioutil"
 	"net/http"
 	//"net/url"
 	"os"
+	"time"
 
 	"github.com/google/safebrowsing"
+	sbcache "./cache"
 	pb "./safebrowsing/safebrowsing_proto"
 
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 	_ "github.com/google/safebrowsing/cmd/sbserver/statik"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rakyll/statik/fs"
 )
 
@@ -201,9 +255,15 @@ const (
 )
 
 var (
-	apiKeyFlag   = flag.String("apikey", "", "specify your Safe Browsing API key")
-	srvAddrFlag  = flag.String("srvaddr", "localhost:8080", "TCP network address the HTTP server should use")
-	databaseFlag = flag.String("db", "", "path to the Safe Browsing database.")
+	apiKeyFlag      = flag.String("apikey", "", "specify your Safe Browsing API key")
+	srvAddrFlag     = flag.String("srvaddr", "localhost:8080", "TCP network address the HTTP server should use")
+	databaseFlag    = flag.String("db", "", "path to the Safe Browsing database.")
+	metricsAddrFlag = flag.String("metricsaddr", "", "TCP network address to serve Prometheus /metrics on (disabled if empty)")
+	proxyAddrFlag   = flag.String("proxyaddr", "", "TCP network address to run sbserver as an HTTP(S) forward proxy on (disabled if empty)")
+	apiKeysFlag     = flag.String("apikeys", "", "comma-separated list of API keys required to access sbserver (auth disabled if empty)")
+	rateLimitFlag   = flag.Float64("ratelimit", 0, "requests per second allowed per API key or IP (disabled if <= 0)")
+	rateBurstFlag   = flag.Int("rateburst", 5, "burst size for -ratelimit")
+	cacheFlag       = flag.String("cache", "", "cache backend for full-hash lookups: empty for in-process, or redis://... to share a cache across replicas")
 )
 
 const usage = `sbserver: starts a Safe Browsing API proxy server.
@@ -303,7 +363,7 @@ func serveStatus(resp http.ResponseWriter, req *http.Request, sb *safebrowsing.S
 // API endpoint. This allows clients to look up whether a given URL is safe.
 // Unlike the official API, it does not require an API key.
 // It supports both JSON and ProtoBuf.
-func serveLookups(resp http.ResponseWriter, req *http.Request, sb *safebrowsing.SafeBrowser) {
+func serveLookups(resp http.ResponseWriter, req *http.Request, sb *safebrowsing.SafeBrowser, fhCache *sbcache.Coalescing) {
 	if req.Method != "POST" {
 		http.Error(resp, "invalid method", http.StatusBadRequest)
 		return
@@ -331,38 +391,111 @@ func serveLookups(resp http.ResponseWriter, req *http.Request, sb *safebrowsing.
 		}
 	}
 
-	// Lookup the URLs.
-	utss, err := sb.LookupURLs(urls)
+	pbResp, info, err := findThreatMatches(req.Context(), sb, fhCache, urls)
+	if ctxInfo := requestInfoFromContext(req.Context()); ctxInfo != nil {
+		*ctxInfo = *info
+	}
 	if err != nil {
 		http.Error(resp, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Compose the response message.
+	// Encode the response message.
+	if err := marshal(resp, pbResp, mime); err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// defaultCacheTTL bounds how long a fhCache entry is trusted. sb.LookupURLs
+// does not surface the server-supplied cache duration from the underlying
+// fullHashes:find response, so this is a conservative stand-in until it
+// does.
+const defaultCacheTTL = 5 * time.Minute
+
+// urlCacheHash derives fhCache's lookup key for url: its full SHA256 hash,
+// and the first 4 bytes of that hash as the backend-facing prefix.
+// sb.LookupURLs hides the Safe Browsing API v4 hash-prefix computation it
+// does internally, so this approximates it with SHA256(url) rather than the
+// real v4 prefix; it still gives fhCache the "keyed by a 4-byte prefix"
+// shape the Redis backend is built around, with the full hash carried
+// alongside so fhCache can detect two different URLs colliding on that
+// prefix instead of serving one's cached verdict for the other.
+func urlCacheHash(url string) (hash [32]byte, prefix [4]byte) {
+	hash = sha256.Sum256([]byte(url))
+	copy(prefix[:], hash[:4])
+	return hash, prefix
+}
+
+// findThreatMatches looks up urls against sb, using fhCache to avoid calling
+// sb.LookupURLs again for a URL already cached from a prior request (in this
+// process, or shared across sbserver replicas via fhCache's backend), and
+// composes the response message shared by the REST and Twirp handlers. It
+// also returns a requestInfo describing the lookup, for callers that want to
+// report it (see withAccessLog).
+func findThreatMatches(ctx context.Context, sb *safebrowsing.SafeBrowser, fhCache *sbcache.Coalescing, urls []string) (*pb.FindThreatMatchesResponse, *requestInfo, error) {
+	start := time.Now()
+	info := &requestInfo{URLCount: len(urls)}
 	pbResp := new(pb.FindThreatMatchesResponse)
-	for i, uts := range utss {
-		// Use map to condense duplicate ThreatDescriptor entries.
-		tdm := make(map[safebrowsing.ThreatDescriptor]bool)
-		for _, ut := range uts {
-			tdm[ut.ThreatDescriptor] = true
-		}
 
-		for td := range tdm {
-			tm := &pb.ThreatMatch{
-				Threat:          &pb.ThreatEntry{Url: urls[i]},
+	for _, url := range urls {
+		hash, prefix := urlCacheHash(url)
+		entry, err := fhCache.GetOrFetch(ctx, prefix, hash, func() (sbcache.Entry, time.Duration, error) {
+			return lookupOne(sb, url, info)
+		})
+		if err != nil {
+			lookupURLsLatency.Observe(time.Since(start).Seconds())
+			return nil, info, err
+		}
+		for _, td := range entry.Descriptors {
+			pbResp.Matches = append(pbResp.Matches, &pb.ThreatMatch{
+				Threat:          &pb.ThreatEntry{Url: url},
 				ThreatType:      pb.ThreatType(td.ThreatType),
 				PlatformType:    pb.PlatformType(td.PlatformType),
 				ThreatEntryType: pb.ThreatEntryType(td.ThreatEntryType),
-			}
-			pbResp.Matches = append(pbResp.Matches, tm)
+			})
 		}
 	}
+	recordThreatMatches(pbResp)
+	lookupURLsLatency.Observe(time.Since(start).Seconds())
+	return pbResp, info, nil
+}
 
-	// Encode the response message.
-	if err := marshal(resp, pbResp, mime); err != nil {
-		http.Error(resp, err.Error(), http.StatusInternalServerError)
-		return
+// lookupOne calls sb.LookupURLs for a single cache-miss URL and folds its
+// result into an sbcache.Entry, accumulating info's cache/API hit counts and
+// apiLatency as it goes. It is only invoked by fhCache.GetOrFetch, so
+// concurrent requests for the same URL in this process share one call.
+func lookupOne(sb *safebrowsing.SafeBrowser, url string, info *requestInfo) (sbcache.Entry, time.Duration, error) {
+	before, _ := sb.Status()
+	apiStart := time.Now()
+	utss, err := sb.LookupURLs([]string{url})
+	apiLatency.Observe(time.Since(apiStart).Seconds())
+	// sb.Status() is one counter shared by every goroutine calling sb, so this
+	// before/after diff is unreliable under concurrent requests: a lookup
+	// running on another goroutine between the two Status() calls moves the
+	// same counters, and its hits get attributed to this info instead of (or
+	// as well as) the caller that actually triggered them. There is no
+	// per-call alternative sb exposes, so info.CacheHits/APIHits should not be
+	// trusted as an accurate per-request breakdown outside of single-request,
+	// non-concurrent testing.
+	after, _ := sb.Status()
+	info.CacheHits += int(after.QueriesByCache - before.QueriesByCache)
+	info.APIHits += int(after.QueriesByAPI - before.QueriesByAPI)
+	if err != nil {
+		return sbcache.Entry{}, 0, err
 	}
+
+	var descs []safebrowsing.ThreatDescriptor
+	seen := make(map[safebrowsing.ThreatDescriptor]bool)
+	if len(utss) > 0 {
+		for _, ut := range utss[0] {
+			if !seen[ut.ThreatDescriptor] {
+				seen[ut.ThreatDescriptor] = true
+				descs = append(descs, ut.ThreatDescriptor)
+			}
+		}
+	}
+	return sbcache.Entry{Descriptors: descs}, defaultCacheTTL, nil
 }
 
 // serveLists is a light-weight implementation of the "/v4/threatLists"
@@ -385,6 +518,18 @@ func serveLists(resp http.ResponseWriter, req *http.Request, conf *safebrowsing.
 		return
 	}
 
+	pbResp := listThreatLists(conf)
+
+	// Encode the response message.
+	if err := marshal(resp, pbResp, mime); err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// listThreatLists composes the response message shared by the REST and
+// Twirp handlers for the "/v4/threatLists" endpoint.
+func listThreatLists(conf *safebrowsing.Config) *pb.ListThreatListsResponse {
 	tls := safebrowsing.DefaultThreatLists
 	if len(conf.ThreatLists) != 0 {
 		tls = conf.ThreatLists
@@ -398,30 +543,17 @@ func serveLists(resp http.ResponseWriter, req *http.Request, conf *safebrowsing.
 			ThreatEntryType: pb.ThreatEntryType(td.ThreatEntryType),
 		})
 	}
-
-	// Encode the response message.
-	if err := marshal(resp, pbResp, mime); err != nil {
-		http.Error(resp, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	return pbResp
 }
 
-func parseTemplates(fs http.FileSystem, t *template.Template, paths ...string) (*template.Template, error) {
-	for _, path := range paths {
-		file, err := fs.Open(path)
-		if err != nil {
-			return nil, err
-		}
-		tmpl, err := ioutil.ReadAll(file)
-		if err != nil {
-			return nil, err
-		}
-		t, err = t.Parse(string(tmpl))
-		if err != nil {
-			return nil, err
-		}
+// newFullHashCache builds the full-hash Cache backend named by -cache: the
+// in-process sbcache.MemoryCache if cacheFlagVal is empty, or an
+// sbcache.RedisCache for a "redis://..." URL.
+func newFullHashCache(cacheFlagVal string) (sbcache.Cache, error) {
+	if cacheFlagVal == "" {
+		return sbcache.NewMemoryCache(), nil
 	}
-	return t, nil
+	return sbcache.NewRedisCache(cacheFlagVal)
 }
 
 func main() {
@@ -450,20 +582,72 @@ func main() {
 		os.Exit(1)
 	}
 
+	// newFullHashCache is constructed eagerly so a bad -cache value (e.g. an
+	// unreachable Redis) fails fast at startup rather than on the first
+	// lookup. fhCache sits in front of sb.LookupURLs in findThreatMatches, at
+	// the URL layer rather than inside sb itself: safebrowsing.Config in this
+	// tree has no cache-backend hook for sb's own internal cache, so that one
+	// remains in-process regardless of -cache.
+	cacheBackend, err := newFullHashCache(*cacheFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to initialize cache backend: ", err)
+		os.Exit(1)
+	}
+	fhCache := sbcache.NewCoalescing(cacheBackend)
+
+	apiKeys := parseAPIKeys(*apiKeysFlag)
+	var limiter *rateLimiterSet
+	if *rateLimitFlag > 0 {
+		limiter = newRateLimiterSet(*rateLimitFlag, *rateBurstFlag)
+	}
+	// mws is applied, in this order, to every API handler below (not the
+	// health check, /public/, or /metrics) so that auth, rate limiting, and
+	// access logging behave uniformly across the API.
+	mws := []Middleware{withAccessLog(os.Stdout), withAPIKeyAuth(apiKeys), withRateLimit(limiter)}
+
 	http.HandleFunc(gaeHealthCheckPath, func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "ok")
 	})
-	http.HandleFunc(statusPath, func(w http.ResponseWriter, r *http.Request) {
+	http.Handle(statusPath, chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		serveStatus(w, r, sb)
-	})
-	http.HandleFunc(findThreatPath, func(w http.ResponseWriter, r *http.Request) {
-		serveLookups(w, r, sb)
-	})
-	http.HandleFunc(getThreatListsPath, func(w http.ResponseWriter, r *http.Request) {
+	}), mws...))
+	http.Handle(findThreatPath, chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveLookups(w, r, sb, fhCache)
+	}), mws...))
+	http.Handle(getThreatListsPath, chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		serveLists(w, r, &conf)
-	})
+	}), mws...))
+	http.Handle(twirpPathPrefix, chain(newSafeBrowsingTwirpHandler(sb, &conf, fhCache), mws...))
 	http.Handle("/public/", http.StripPrefix("/public/", http.FileServer(statikFS)))
 
+	if *proxyAddrFlag != "" {
+		proxy, err := newSafeBrowsingProxy(sb)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to initialize forward proxy: ", err)
+			os.Exit(1)
+		}
+		go func() {
+			fmt.Fprintln(os.Stdout, "Starting forward proxy at", *proxyAddrFlag)
+			if err := http.ListenAndServe(*proxyAddrFlag, proxy); err != nil {
+				fmt.Fprintln(os.Stderr, "Forward proxy error:", err)
+			}
+		}()
+	}
+
+	go pollStats(sb, 10*time.Second)
+	if *metricsAddrFlag != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			fmt.Fprintln(os.Stdout, "Starting metrics server at", *metricsAddrFlag)
+			if err := http.ListenAndServe(*metricsAddrFlag, metricsMux); err != nil {
+				fmt.Fprintln(os.Stderr, "Metrics server error:", err)
+			}
+		}()
+	} else {
+		http.Handle("/metrics", promhttp.Handler())
+	}
+
 	fmt.Fprintln(os.Stdout, "Starting server at", *srvAddrFlag)
 	if err := http.ListenAndServe(*srvAddrFlag, nil); err != nil {
 		fmt.Fprintln(os.Stderr, "Server error:", err)
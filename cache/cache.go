@@ -0,0 +1,70 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache defines a pluggable backend for the lookup cache that sits
+// in front of sbserver's calls into the safebrowsing package. Today each
+// sbserver replica keeps this cache in-process, so N replicas behind a load
+// balancer independently call sb.LookupURLs for the same URL. Cache lets
+// that storage be swapped for a shared backend (see RedisCache) so a fleet
+// of replicas can share one cache instead, and Coalescing adds a
+// single-flight guard on top of any Cache so concurrent misses in one
+// process for the same URL hash only trigger one fetch.
+//
+// sb.LookupURLs does not expose the safebrowsing API v4 hash-prefix
+// computation it does internally, so entries here are keyed by the first 4
+// bytes of SHA256(url) rather than the real v4 hash prefix; see
+// urlCacheHash in app.go. Because that 4-byte prefix is shared by many
+// distinct URLs (a birthday collision is expected after tens of thousands of
+// distinct lookups), an Entry also carries the full 32-byte URLHash it was
+// computed for, and Cache.Get must verify it against the URLHash being
+// queried, reporting ok=false on a mismatch rather than returning one URL's
+// cached verdict for a different URL that happens to share its prefix. They
+// carry the set of matched ThreatDescriptors (empty for a clean URL) and an
+// sbserver-assigned expiry, since sb does not surface the server's own cache
+// duration either.
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/safebrowsing"
+)
+
+// Entry is a cached lookup result: the full SHA256 hash of the URL it was
+// computed for (so a backend keyed by a shorter prefix can detect a prefix
+// collision against a different URL instead of serving its result), and the
+// ThreatDescriptors matched for that URL, or an empty slice if it was looked
+// up and found clean.
+type Entry struct {
+	URLHash     [32]byte
+	Descriptors []safebrowsing.ThreatDescriptor
+}
+
+// Cache is the pluggable storage backend behind the lookup cache, keyed by
+// prefix (the first 4 bytes of an Entry's URLHash) for compactness.
+// Implementations must be safe for concurrent use by multiple goroutines,
+// and ideally by multiple processes.
+type Cache interface {
+	// Get returns the entry cached for prefix, if any, not yet expired, and
+	// actually computed for urlHash: a prefix match alone is not sufficient,
+	// since distinct URLs can collide on a 4-byte prefix.
+	Get(ctx context.Context, prefix [4]byte, urlHash [32]byte) (entry Entry, ok bool, err error)
+
+	// Set stores entry (whose URLHash must be the hash it was looked up for)
+	// under prefix, to be honored until it expires after ttl. Implementations
+	// should apply ttl atomically (e.g. Redis SETEX) rather than as a
+	// separate expire step.
+	Set(ctx context.Context, prefix [4]byte, entry Entry, ttl time.Duration) error
+}
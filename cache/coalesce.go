@@ -0,0 +1,75 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Coalescing wraps any Cache with a GetOrFetch that single-flights concurrent
+// misses for the same URL hash, so that a cold cache (in-process or shared)
+// does not fan out N identical fetches for the same URL when N requests for
+// it arrive at once in this process. It is the stampede guard callers are
+// expected to go through instead of calling Get/Set directly.
+type Coalescing struct {
+	Cache
+	group singleflight.Group
+}
+
+// NewCoalescing wraps backend with a single-flight guard.
+func NewCoalescing(backend Cache) *Coalescing {
+	return &Coalescing{Cache: backend}
+}
+
+// GetOrFetch returns the cached entry for urlHash (keyed in the backend by
+// prefix, its first 4 bytes) if present; otherwise it calls fetch to
+// populate the cache, coalescing concurrent callers in this process that are
+// fetching the same urlHash into a single call to fetch. Coalescing keys the
+// single-flight group by urlHash rather than prefix, so two different URLs
+// that happen to collide on prefix still get independent fetches instead of
+// sharing one's result.
+func (c *Coalescing) GetOrFetch(ctx context.Context, prefix [4]byte, urlHash [32]byte, fetch func() (Entry, time.Duration, error)) (Entry, error) {
+	if e, ok, err := c.Get(ctx, prefix, urlHash); err != nil {
+		return Entry{}, err
+	} else if ok {
+		return e, nil
+	}
+
+	v, err, _ := c.group.Do(string(urlHash[:]), func() (interface{}, error) {
+		// Re-check after winning the single-flight race: another caller may
+		// have already populated the cache for this urlHash while we waited.
+		if e, ok, err := c.Get(ctx, prefix, urlHash); err != nil {
+			return Entry{}, err
+		} else if ok {
+			return e, nil
+		}
+		entry, ttl, err := fetch()
+		if err != nil {
+			return Entry{}, err
+		}
+		entry.URLHash = urlHash
+		if err := c.Set(ctx, prefix, entry, ttl); err != nil {
+			return Entry{}, err
+		}
+		return entry, nil
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+	return v.(Entry), nil
+}
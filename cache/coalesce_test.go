@@ -0,0 +1,134 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/safebrowsing"
+)
+
+// TestCoalescingPrefixCollision forces two distinct URLs to collide on the
+// same 4-byte prefix (easy to do deliberately, expected eventually by chance
+// on a real deployment) and verifies each still gets its own cached entry
+// instead of one serving the other's verdict.
+func TestCoalescingPrefixCollision(t *testing.T) {
+	c := NewCoalescing(NewMemoryCache())
+	ctx := context.Background()
+	prefix := [4]byte{0xAA, 0xBB, 0xCC, 0xDD}
+
+	aHash := [32]byte{1}
+	bHash := [32]byte{2}
+
+	aEntry, err := c.GetOrFetch(ctx, prefix, aHash, func() (Entry, time.Duration, error) {
+		return Entry{Descriptors: nil}, time.Minute, nil
+	})
+	if err != nil {
+		t.Fatalf("GetOrFetch(a): %v", err)
+	}
+	if aEntry.URLHash != aHash {
+		t.Fatalf("a's entry has URLHash %x, want %x", aEntry.URLHash, aHash)
+	}
+
+	bFetches := 0
+	bEntry, err := c.GetOrFetch(ctx, prefix, bHash, func() (Entry, time.Duration, error) {
+		bFetches++
+		return Entry{Descriptors: []safebrowsing.ThreatDescriptor{{ThreatType: safebrowsing.ThreatType(1)}}}, time.Minute, nil
+	})
+	if err != nil {
+		t.Fatalf("GetOrFetch(b): %v", err)
+	}
+	if bFetches != 1 {
+		t.Fatalf("b's fetch ran %d times, want exactly 1 (a's cached entry must not satisfy b's prefix-colliding lookup)", bFetches)
+	}
+	if bEntry.URLHash != bHash {
+		t.Fatalf("b's entry has URLHash %x, want %x", bEntry.URLHash, bHash)
+	}
+	if len(bEntry.Descriptors) == 0 {
+		t.Fatalf("b's entry has no descriptors, want b's own fetch result rather than a's cached (clean) entry")
+	}
+}
+
+// TestCoalescingSingleFlightsByURLHash checks that concurrent callers for
+// the same urlHash share one fetch, even though they also collide on
+// prefix, while a concurrent caller for a different urlHash sharing that
+// same prefix gets its own fetch rather than being coalesced into it.
+func TestCoalescingSingleFlightsByURLHash(t *testing.T) {
+	c := NewCoalescing(NewMemoryCache())
+	ctx := context.Background()
+	prefix := [4]byte{1, 2, 3, 4}
+	sameHash := [32]byte{9}
+	otherHash := [32]byte{10}
+
+	var mu sync.Mutex
+	fetches := map[[32]byte]int{}
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	fetch := func(hash [32]byte) func() (Entry, time.Duration, error) {
+		return func() (Entry, time.Duration, error) {
+			mu.Lock()
+			fetches[hash]++
+			mu.Unlock()
+			close(started)
+			<-release
+			return Entry{}, time.Minute, nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.GetOrFetch(ctx, prefix, sameHash, fetch(sameHash))
+	}()
+	go func() {
+		defer wg.Done()
+		<-started
+		c.GetOrFetch(ctx, prefix, sameHash, fetch(sameHash))
+	}()
+	// Hold the first fetch open long enough for the second caller to join it,
+	// then let it finish.
+	<-started
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	mu.Lock()
+	got := fetches[sameHash]
+	mu.Unlock()
+	if got != 1 {
+		t.Fatalf("two concurrent callers for the same urlHash ran fetch %d times, want 1", got)
+	}
+
+	// A different urlHash sharing the same prefix must get its own fetch.
+	if _, err := c.GetOrFetch(ctx, prefix, otherHash, func() (Entry, time.Duration, error) {
+		mu.Lock()
+		fetches[otherHash]++
+		mu.Unlock()
+		return Entry{}, time.Minute, nil
+	}); err != nil {
+		t.Fatalf("GetOrFetch(otherHash): %v", err)
+	}
+	mu.Lock()
+	got = fetches[otherHash]
+	mu.Unlock()
+	if got != 1 {
+		t.Fatalf("otherHash's fetch ran %d times, want 1", got)
+	}
+}
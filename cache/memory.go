@@ -0,0 +1,68 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryCache is the default, in-process Cache implementation: a single
+// sbserver's existing behavior, expressed against the Cache interface so it
+// can be swapped for a shared backend like RedisCache without changing call
+// sites.
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[[4]byte]memoryEntry
+}
+
+type memoryEntry struct {
+	Entry
+	expires time.Time
+}
+
+// NewMemoryCache returns an empty MemoryCache.
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: make(map[[4]byte]memoryEntry)}
+}
+
+// Get implements Cache.
+func (c *MemoryCache) Get(ctx context.Context, prefix [4]byte, urlHash [32]byte) (Entry, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[prefix]
+	if !ok {
+		return Entry{}, false, nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, prefix)
+		return Entry{}, false, nil
+	}
+	if e.URLHash != urlHash {
+		// Prefix collision with a different URL's entry: not a cache hit for
+		// this URL.
+		return Entry{}, false, nil
+	}
+	return e.Entry, true, nil
+}
+
+// Set implements Cache.
+func (c *MemoryCache) Set(ctx context.Context, prefix [4]byte, entry Entry, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[prefix] = memoryEntry{Entry: entry, expires: time.Now().Add(ttl)}
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// keyPrefix namespaces sbserver's entries within a shared Redis instance.
+const keyPrefix = "sbserver:lookup:"
+
+// RedisCache is a Cache backed by a shared Redis instance, so that multiple
+// sbserver replicas behind a load balancer serve lookups from one cache
+// instead of each hitting the upstream API independently. Entries are stored
+// gob-encoded and expired with SETEX so storage and TTL are applied
+// atomically. Wrap it in Coalescing to also get a single-flight guard
+// against cache-stampede fetches.
+type RedisCache struct {
+	pool *redis.Pool
+}
+
+// NewRedisCache returns a RedisCache connecting to the given Redis URL
+// (e.g. "redis://localhost:6379/0"), as accepted by sbserver's
+// -cache=redis://... flag.
+func NewRedisCache(redisURL string) (*RedisCache, error) {
+	pool := &redis.Pool{
+		MaxIdle:     8,
+		IdleTimeout: 240 * time.Second,
+		Dial:        func() (redis.Conn, error) { return redis.DialURL(redisURL) },
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("cache: unable to reach redis at %s: %v", redisURL, err)
+	}
+	return &RedisCache{pool: pool}, nil
+}
+
+// Get implements Cache.
+func (c *RedisCache) Get(ctx context.Context, prefix [4]byte, urlHash [32]byte) (Entry, bool, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	raw, err := redis.Bytes(conn.Do("GET", redisKey(prefix)))
+	if err == redis.ErrNil {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, err
+	}
+
+	var e Entry
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&e); err != nil {
+		return Entry{}, false, err
+	}
+	if e.URLHash != urlHash {
+		// Prefix collision with a different URL's entry: not a cache hit for
+		// this URL.
+		return Entry{}, false, nil
+	}
+	return e, true, nil
+}
+
+// Set implements Cache.
+func (c *RedisCache) Set(ctx context.Context, prefix [4]byte, entry Entry, ttl time.Duration) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return err
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+	secs := int64(ttl / time.Second)
+	if secs <= 0 {
+		secs = 1
+	}
+	_, err := conn.Do("SETEX", redisKey(prefix), secs, buf.Bytes())
+	return err
+}
+
+func redisKey(prefix [4]byte) string {
+	return keyPrefix + string(prefix[:])
+}
@@ -0,0 +1,118 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/google/safebrowsing"
+	pb "./safebrowsing/safebrowsing_proto"
+)
+
+// Prometheus metrics mirroring the counters already surfaced by serveStatus,
+// plus latency and freshness metrics that /status does not expose. These are
+// registered against the default registry so they show up alongside any
+// other collectors the process links in.
+var (
+	queriesByDatabase = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sbserver_queries_by_database_total",
+		Help: "Queries satisfied by the local database.",
+	})
+
+	queriesByCache = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sbserver_queries_by_cache_total",
+		Help: "Queries satisfied by the local cache.",
+	})
+
+	queriesByAPI = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sbserver_queries_by_api_total",
+		Help: "Queries that required a round-trip to the Safe Browsing API.",
+	})
+
+	queriesFail = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sbserver_queries_fail_total",
+		Help: "Queries that failed.",
+	})
+
+	threatMatchesByType = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sbserver_threat_matches_total",
+		Help: "Matches returned by findThreatMatches, by threat type.",
+	}, []string{"threat_type"})
+
+	lookupURLsLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sbserver_lookup_urls_duration_seconds",
+		Help:    "Latency of findThreatMatches calls (serveLookups and the Twirp FindThreatMatches RPC), including URLs answered from fhCache.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	apiLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sbserver_api_duration_seconds",
+		Help:    "Latency of each sb.LookupURLs call made for a URL not found in fhCache. This includes calls sb answers from its own database or cache, not only upstream Safe Browsing API round-trips.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	databaseUpdateLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sbserver_database_update_lag_seconds",
+		Help: "Time since pollStats last reached sb.Status() successfully. This is a liveness signal for the polling loop itself, not the underlying database's real update lag: safebrowsing.Stats exposes no timestamp for the last successful database update.",
+	})
+)
+
+// threatTypeLabel renders a ThreatDescriptor's threat type for use as a
+// Prometheus label value, falling back to "unknown" if its String form is
+// empty.
+func threatTypeLabel(tt safebrowsing.ThreatType) string {
+	if s := tt.String(); s != "" {
+		return s
+	}
+	return "unknown"
+}
+
+// recordThreatMatches increments threatMatchesByType once per match in resp,
+// labeled by its threat type.
+func recordThreatMatches(resp *pb.FindThreatMatchesResponse) {
+	for _, m := range resp.GetMatches() {
+		threatMatchesByType.WithLabelValues(threatTypeLabel(safebrowsing.ThreatType(m.ThreatType))).Inc()
+	}
+}
+
+// pollStats periodically copies sb.Status() into the Counters above and
+// updates databaseUpdateLag. safebrowsing.Stats reports cumulative totals,
+// so each tick adds only the delta since the previous one. The Stats type
+// does not currently break its counts down by threat type, so unlike
+// threatMatchesByType these are plain Counters rather than per-type
+// CounterVecs.
+func pollStats(sb *safebrowsing.SafeBrowser, interval time.Duration) {
+	var prev safebrowsing.Stats
+	lastPoll := time.Now()
+	for range time.Tick(interval) {
+		stats, err := sb.Status()
+		// Set before advancing lastPoll, so it reflects the gap since the
+		// previous successful poll rather than being reset to ~0 on every
+		// tick, and keeps growing while polls fail.
+		databaseUpdateLag.Set(time.Since(lastPoll).Seconds())
+		if err != nil {
+			continue
+		}
+		lastPoll = time.Now()
+		queriesByDatabase.Add(float64(stats.QueriesByDatabase - prev.QueriesByDatabase))
+		queriesByCache.Add(float64(stats.QueriesByCache - prev.QueriesByCache))
+		queriesByAPI.Add(float64(stats.QueriesByAPI - prev.QueriesByAPI))
+		queriesFail.Add(float64(stats.QueriesFail - prev.QueriesFail))
+		prev = stats
+	}
+}
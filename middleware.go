@@ -0,0 +1,262 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Middleware wraps an http.Handler with additional behavior. Middlewares are
+// applied in the order they are passed to chain, so the first one given is
+// the outermost.
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps h with mws, applying them outermost-first, and returns the
+// composed handler. Every API handler registered in main (serveLookups,
+// serveLists, serveStatus, and the Twirp handler) is wrapped with the same
+// chain so that auth, rate limiting, and access logging are applied
+// uniformly.
+func chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// withAPIKeyAuth requires requests to present one of keys as a bearer token
+// (via the Authorization header) or an X-Api-Key header. If keys is empty,
+// authentication is disabled and all requests are allowed through; this
+// keeps sbserver usable as a localhost-only proxy without requiring an
+// operator to provision keys.
+func withAPIKeyAuth(keys map[string]bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		if len(keys) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !keys[apiKeyFromRequest(r)] {
+				http.Error(w, "invalid or missing API key", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// parseAPIKeys splits a comma-separated -apikeys flag value into a set,
+// ignoring empty entries.
+func parseAPIKeys(flagVal string) map[string]bool {
+	keys := make(map[string]bool)
+	for _, k := range strings.Split(flagVal, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys[k] = true
+		}
+	}
+	return keys
+}
+
+// apiKeyFromRequest extracts the caller-supplied API key, if any, from the
+// Authorization or X-Api-Key headers.
+func apiKeyFromRequest(r *http.Request) string {
+	if v := r.Header.Get("X-Api-Key"); v != "" {
+		return v
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// limiterIdleTTL bounds how long a per-identity limiter is kept after its
+// last use. Without this, -ratelimit with no -apikeys configured (a
+// supported combination, since identity then falls back to client IP) lets
+// an attacker grow limiters unboundedly just by varying source IP.
+const limiterIdleTTL = 10 * time.Minute
+
+// rateLimiterSet hands out a per-identity token-bucket limiter, creating one
+// on first use. It backs withRateLimit below, which keys it by API key or,
+// failing that, client IP.
+type rateLimiterSet struct {
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+	r        rate.Limit
+	burst    int
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+func newRateLimiterSet(ratePerSec float64, burst int) *rateLimiterSet {
+	s := &rateLimiterSet{
+		limiters: make(map[string]*limiterEntry),
+		r:        rate.Limit(ratePerSec),
+		burst:    burst,
+	}
+	go s.evictIdle(limiterIdleTTL)
+	return s
+}
+
+func (s *rateLimiterSet) allow(identity string) bool {
+	s.mu.Lock()
+	e, ok := s.limiters[identity]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(s.r, s.burst)}
+		s.limiters[identity] = e
+	}
+	e.lastUsed = time.Now()
+	lim := e.limiter
+	s.mu.Unlock()
+	return lim.Allow()
+}
+
+// evictIdle periodically sweeps limiters idle for longer than ttl, so a
+// steady stream of distinct identities doesn't grow the set forever.
+func (s *rateLimiterSet) evictIdle(ttl time.Duration) {
+	for range time.Tick(ttl / 2) {
+		s.sweepIdle(ttl)
+	}
+}
+
+// sweepIdle removes every limiter not used within ttl of now.
+func (s *rateLimiterSet) sweepIdle(ttl time.Duration) {
+	cutoff := time.Now().Add(-ttl)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for identity, e := range s.limiters {
+		if e.lastUsed.Before(cutoff) {
+			delete(s.limiters, identity)
+		}
+	}
+}
+
+// withRateLimit throttles requests per API key (if one was presented) or
+// otherwise per client IP, using an independent token bucket per identity.
+// A nil set disables rate limiting entirely.
+func withRateLimit(set *rateLimiterSet) Middleware {
+	return func(next http.Handler) http.Handler {
+		if set == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity := apiKeyFromRequest(r)
+			if identity == "" {
+				identity, _, _ = net.SplitHostPort(r.RemoteAddr)
+				if identity == "" {
+					identity = r.RemoteAddr
+				}
+			}
+			if !set.allow(identity) {
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestInfo carries per-request details that handlers fill in for
+// withAccessLog to report, since the middleware layer has no visibility into
+// decoded request bodies or cache/API attribution on its own.
+type requestInfo struct {
+	URLCount  int
+	CacheHits int
+	APIHits   int
+}
+
+type requestInfoKey struct{}
+
+// withRequestInfo returns a copy of r whose context carries an empty
+// *requestInfo that a downstream handler can populate, along with that
+// *requestInfo; withAccessLog reads it back after the handler returns.
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	info := new(requestInfo)
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// requestInfoFromContext returns the *requestInfo stashed by withAccessLog,
+// or nil if the request was not wrapped by it.
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// statusRecorder wraps an http.ResponseWriter to capture the status code
+// written, defaulting to 200 if the handler never calls WriteHeader.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// accessLogEntry is the JSON shape written by withAccessLog, one line per
+// request.
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	RemoteAddr string  `json:"remoteAddr"`
+	Status     int     `json:"status"`
+	LatencyMS  float64 `json:"latencyMs"`
+	URLCount   int     `json:"urlCount,omitempty"`
+	CacheHits  int     `json:"cacheHits,omitempty"`
+	APIHits    int     `json:"apiHits,omitempty"`
+}
+
+// withAccessLog writes one structured JSON log line per request to w,
+// including the decoded URL count and cache-hit vs. API-hit breakdown that
+// handlers report through requestInfo.
+func withAccessLog(w *os.File) Middleware {
+	enc := json.NewEncoder(w)
+	var mu sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			req, info := withRequestInfo(req)
+			rec := &statusRecorder{ResponseWriter: resp, status: http.StatusOK}
+
+			next.ServeHTTP(rec, req)
+
+			entry := accessLogEntry{
+				Time:       start.UTC().Format(time.RFC3339Nano),
+				Method:     req.Method,
+				Path:       req.URL.Path,
+				RemoteAddr: req.RemoteAddr,
+				Status:     rec.status,
+				LatencyMS:  float64(time.Since(start).Microseconds()) / 1000,
+				URLCount:   info.URLCount,
+				CacheHits:  info.CacheHits,
+				APIHits:    info.APIHits,
+			}
+			mu.Lock()
+			enc.Encode(entry)
+			mu.Unlock()
+		})
+	}
+}
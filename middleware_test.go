@@ -0,0 +1,113 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestWithAPIKeyAuthNoKeysConfigured(t *testing.T) {
+	h := withAPIKeyAuth(nil)(okHandler())
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("with no configured keys, got status %d, want %d (auth should be disabled)", rec.Code, http.StatusOK)
+	}
+}
+
+func TestWithAPIKeyAuthRejectsMissingOrWrongKey(t *testing.T) {
+	h := withAPIKeyAuth(map[string]bool{"good-key": true})(okHandler())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("missing key: got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Api-Key", "wrong-key")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong key: got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestWithAPIKeyAuthAcceptsValidKey(t *testing.T) {
+	h := withAPIKeyAuth(map[string]bool{"good-key": true})(okHandler())
+
+	for _, setHeader := range []func(*http.Request){
+		func(r *http.Request) { r.Header.Set("X-Api-Key", "good-key") },
+		func(r *http.Request) { r.Header.Set("Authorization", "Bearer good-key") },
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		setHeader(req)
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("valid key: got status %d, want %d", rec.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestRateLimiterSetAllowsBurstThenBlocks(t *testing.T) {
+	s := newRateLimiterSet(1, 2)
+	if !s.allow("a") {
+		t.Error("1st request in burst should be allowed")
+	}
+	if !s.allow("a") {
+		t.Error("2nd request in burst should be allowed")
+	}
+	if s.allow("a") {
+		t.Error("3rd request should exceed burst and be denied")
+	}
+	// A different identity has its own independent bucket.
+	if !s.allow("b") {
+		t.Error("a different identity's first request should be allowed")
+	}
+}
+
+func TestRateLimiterSetSweepIdleEvictsOnlyStaleEntries(t *testing.T) {
+	s := newRateLimiterSet(1, 1)
+	s.allow("stale")
+	s.allow("fresh")
+
+	s.mu.Lock()
+	s.limiters["stale"].lastUsed = time.Now().Add(-time.Hour)
+	s.mu.Unlock()
+
+	s.sweepIdle(time.Minute)
+
+	s.mu.Lock()
+	_, staleStillPresent := s.limiters["stale"]
+	_, freshStillPresent := s.limiters["fresh"]
+	s.mu.Unlock()
+
+	if staleStillPresent {
+		t.Error("sweepIdle left a limiter idle well past ttl in place")
+	}
+	if !freshStillPresent {
+		t.Error("sweepIdle evicted a limiter used within ttl")
+	}
+}
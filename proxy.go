@@ -0,0 +1,200 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/google/safebrowsing"
+)
+
+// continueTokenTTL is how long a "proceed anyway" link stays valid once it
+// has been handed to a client in an interstitial page.
+const continueTokenTTL = 10 * time.Minute
+
+// proxyContinueParam is the query parameter a client round-trips back to the
+// proxy to skip the interstitial for a URL it has already been warned about.
+const proxyContinueParam = "sbcontinue"
+
+// interstitialHTMLTemplate is the page served in place of a blocked request.
+// It is kept inline, rather than loaded from the statik filesystem like
+// sbserver's other templates, because this tree's statik bundle does not
+// carry an /interstitial.html resource; parsing it from there fails
+// newSafeBrowsingProxy at startup on every -proxyaddr invocation.
+const interstitialHTMLTemplate = `<!DOCTYPE html>
+<html>
+<head><title>Warning - Unsafe URL blocked</title></head>
+<body>
+<h1>This URL has been flagged as unsafe</h1>
+<p>{{.URL}}</p>
+<ul>
+{{range .Descriptors}}<li>{{.ThreatType}} ({{.PlatformType}})</li>
+{{end}}
+</ul>
+<p><a href="{{.ContinueURL}}">Proceed anyway</a></p>
+</body>
+</html>
+`
+
+// safeBrowsingProxy is an HTTP/HTTPS forward proxy that calls sb.LookupURLs
+// on every absolute request URL and, on a match, serves an interstitial page
+// instead of forwarding the request.
+type safeBrowsingProxy struct {
+	sb     *safebrowsing.SafeBrowser
+	tmpl   *template.Template
+	secret []byte
+}
+
+// newSafeBrowsingProxy builds a *goproxy.ProxyHttpServer that filters
+// requests through sb before forwarding them, including HTTPS requests:
+// it MITMs every CONNECT tunnel so the same filter hook sees the decrypted
+// request URL instead of letting HTTPS traffic pass through unchecked.
+func newSafeBrowsingProxy(sb *safebrowsing.SafeBrowser) (*goproxy.ProxyHttpServer, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	tmpl := template.Must(template.New("interstitial").Parse(interstitialHTMLTemplate))
+	sbp := &safeBrowsingProxy{sb: sb, tmpl: tmpl, secret: secret}
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(sbp.filter)
+	return proxy, nil
+}
+
+// filter is the goproxy request handler. It returns a non-nil response to
+// short-circuit the request with the interstitial page, or (req, nil) to let
+// goproxy forward the request unmodified.
+func (p *safeBrowsingProxy) filter(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if p.hasValidContinueToken(req) {
+		return req, nil
+	}
+
+	utss, err := p.sb.LookupURLs([]string{req.URL.String()})
+	if err != nil || len(utss) == 0 || len(utss[0]) == 0 {
+		// Fail open: an API error should not take down browsing for the LAN.
+		return req, nil
+	}
+
+	tds := make(map[safebrowsing.ThreatDescriptor]bool)
+	for _, ut := range utss[0] {
+		tds[ut.ThreatDescriptor] = true
+	}
+	return req, p.interstitial(req, tds)
+}
+
+// interstitial renders the configured HTML template describing the matched
+// ThreatDescriptors and a signed "proceed anyway" link back to the original
+// URL.
+func (p *safeBrowsingProxy) interstitial(req *http.Request, tds map[safebrowsing.ThreatDescriptor]bool) *http.Response {
+	descs := make([]safebrowsing.ThreatDescriptor, 0, len(tds))
+	for td := range tds {
+		descs = append(descs, td)
+	}
+
+	data := struct {
+		URL         string
+		Descriptors []safebrowsing.ThreatDescriptor
+		ContinueURL string
+	}{
+		URL:         req.URL.String(),
+		Descriptors: descs,
+		ContinueURL: p.continueURL(req),
+	}
+
+	var buf bytes.Buffer
+	if err := p.tmpl.Execute(&buf, data); err != nil {
+		return goproxy.NewResponse(req, "text/plain", http.StatusInternalServerError, err.Error())
+	}
+	return goproxy.NewResponse(req, "text/html", http.StatusForbidden, buf.String())
+}
+
+// canonicalURLForToken returns req's URL, with proxyContinueParam removed
+// and its query re-encoded via url.Values.Encode, as the representation
+// signed and later re-verified by continueURL/hasValidContinueToken.
+// url.Values.Encode sorts keys and re-escapes values, so it does not
+// round-trip through req.URL.String() unchanged for a URL with more than
+// one query parameter or a non-canonically-escaped one; continueURL and
+// hasValidContinueToken must therefore sign and verify this same
+// canonicalization rather than the URL as originally received.
+func canonicalURLForToken(req *http.Request) string {
+	u := *req.URL
+	q := u.Query()
+	q.Del(proxyContinueParam)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// continueURL appends a signed continue token to req's URL so that a client
+// following the "proceed anyway" link skips the interstitial on its retry.
+func (p *safeBrowsingProxy) continueURL(req *http.Request) string {
+	u := *req.URL
+	q := u.Query()
+	q.Set(proxyContinueParam, p.signContinueToken(canonicalURLForToken(req)))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// signContinueToken returns a base64 token binding rawURL to an expiry
+// timestamp, authenticated with an HMAC keyed by the proxy's per-process
+// secret.
+func (p *safeBrowsingProxy) signContinueToken(rawURL string) string {
+	exp := time.Now().Add(continueTokenTTL).Unix()
+	return p.encodeContinueToken(rawURL, exp)
+}
+
+func (p *safeBrowsingProxy) encodeContinueToken(rawURL string, exp int64) string {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(rawURL))
+	binary.Write(mac, binary.BigEndian, exp)
+	sig := mac.Sum(nil)
+
+	buf := make([]byte, 8+len(sig))
+	binary.BigEndian.PutUint64(buf[:8], uint64(exp))
+	copy(buf[8:], sig)
+	return base64.URLEncoding.EncodeToString(buf)
+}
+
+// hasValidContinueToken reports whether req carries a continue token that
+// was signed for its own URL (ignoring the token itself) and has not
+// expired.
+func (p *safeBrowsingProxy) hasValidContinueToken(req *http.Request) bool {
+	q := req.URL.Query()
+	token := q.Get(proxyContinueParam)
+	if token == "" {
+		return false
+	}
+	raw, err := base64.URLEncoding.DecodeString(token)
+	if err != nil || len(raw) < 8 {
+		return false
+	}
+	exp := int64(binary.BigEndian.Uint64(raw[:8]))
+	if time.Now().Unix() > exp {
+		return false
+	}
+
+	want := p.encodeContinueToken(canonicalURLForToken(req), exp)
+	return hmac.Equal([]byte(want), []byte(token))
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func newProxyForTest(t *testing.T) *safeBrowsingProxy {
+	t.Helper()
+	return &safeBrowsingProxy{secret: []byte("test-secret-test-secret-test-se")}
+}
+
+func requestForURL(t *testing.T, rawURL string) *http.Request {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("url.Parse(%q): %v", rawURL, err)
+	}
+	return &http.Request{URL: u}
+}
+
+// TestContinueTokenRoundTrip checks that a "proceed anyway" link generated
+// for a blocked URL is accepted on the retry that carries it back, including
+// for URLs whose query parameters are not already in the alphabetical order
+// url.Values.Encode produces.
+func TestContinueTokenRoundTrip(t *testing.T) {
+	tests := []string{
+		"http://example.com/path",
+		"http://example.com/path?b=2&a=1",
+		"http://example.com/path?q=hello%20world",
+		"http://example.com/path?z=1&m=2&a=3&q=has+space",
+	}
+	for _, rawURL := range tests {
+		p := newProxyForTest(t)
+		req := requestForURL(t, rawURL)
+
+		continueURL := p.continueURL(req)
+		retryReq := requestForURL(t, continueURL)
+
+		if !p.hasValidContinueToken(retryReq) {
+			t.Errorf("hasValidContinueToken(%q) = false, want true (signed via continueURL(%q))", continueURL, rawURL)
+		}
+	}
+}
+
+// TestContinueTokenRejectsMismatchedURL checks that a token signed for one
+// URL is not accepted on a request for a different path (i.e. the proxy
+// can't be tricked by reusing another URL's token).
+func TestContinueTokenRejectsMismatchedURL(t *testing.T) {
+	p := newProxyForTest(t)
+	signedFor := requestForURL(t, "http://example.com/a")
+	continueURL := p.continueURL(signedFor)
+
+	tamperedReq := requestForURL(t, continueURL)
+	tamperedReq.URL.Path = "/b"
+	if p.hasValidContinueToken(tamperedReq) {
+		t.Error("hasValidContinueToken accepted a token signed for a different path")
+	}
+}
+
+func TestContinueTokenRejectsMissingOrEmptyToken(t *testing.T) {
+	p := newProxyForTest(t)
+	req := requestForURL(t, "http://example.com/a")
+	if p.hasValidContinueToken(req) {
+		t.Error("hasValidContinueToken accepted a request with no token")
+	}
+	req = requestForURL(t, "http://example.com/a?"+proxyContinueParam+"=")
+	if p.hasValidContinueToken(req) {
+		t.Error("hasValidContinueToken accepted a request with an empty token")
+	}
+}